@@ -0,0 +1,71 @@
+package wlock
+
+import (
+	"encoding/json"
+
+	"go.etcd.io/bbolt"
+)
+
+var boltLockersBucket = []byte("lockers")
+
+// BoltStore is a Store backed by a bbolt database. Unlike FileStore,
+// every Save/Delete commits its own transaction, so Snapshot has
+// nothing additional to do.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) a bbolt database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0o644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltLockersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]*Locker, error) {
+	var list []*Locker
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltLockersBucket).ForEach(func(k, v []byte) error {
+			l := new(Locker)
+			if err := json.Unmarshal(v, l); err != nil {
+				return err
+			}
+			list = append(list, l)
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *BoltStore) Save(l *Locker) error {
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltLockersBucket).Put([]byte(l.Id), raw)
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltLockersBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Snapshot() error {
+	return nil
+}
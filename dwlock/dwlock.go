@@ -0,0 +1,251 @@
+// Package dwlock turns wlock.LockerManager into a replicated lock
+// service. A Client fans a Lock/RLock request out to every peer
+// concurrently and considers the lock held once a quorum of peers have
+// granted it, compensating with Unlock on any peers that granted but
+// fell short of quorum.
+package dwlock
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// LockMode distinguishes shared (read) grants from exclusive (write)
+// grants, mirroring the distinction peers make when deciding whether a
+// new grant can coexist with what they already hold for an id.
+type LockMode int
+
+const (
+	Exclusive LockMode = iota
+	Shared
+)
+
+// Peer is the transport a Client uses to talk to one node of the
+// cluster. Implementations are expected to be safe for concurrent use,
+// since a Client calls all of its peers at once. heldBy is the UID a
+// peer reports as the current holder when it rejects a grant; peers
+// that can't report one (a down peer, or a transport with no way to
+// surface it) return "".
+type Peer interface {
+	Lock(id, uid string, mode LockMode) (token string, ok bool, heldBy string)
+	Unlock(id, token string) bool
+	Refresh(id, token string) bool
+	ForceUnlock(id string) bool
+}
+
+// ErrNoQuorum is returned when fewer than the required quorum of peers
+// granted a lock; any peers that did grant are compensated with Unlock
+// before this error is returned. Lock/RLock actually return a
+// *QuorumError wrapping it, so callers that want the contending UIDs
+// can errors.As for it; callers that only care that quorum failed can
+// keep comparing against ErrNoQuorum via errors.Is.
+var ErrNoQuorum = errors.New("dwlock: failed to reach quorum")
+
+// QuorumError is the error Lock/RLock return when they fail to reach
+// quorum. Contenders lists the UID each rejecting peer reported as the
+// current holder, one entry per such peer (peers that simply couldn't
+// be reached contribute nothing). LockRetry uses it to decide, via
+// Yield, whether to back off or retry immediately.
+type QuorumError struct {
+	Contenders []string
+}
+
+func (e *QuorumError) Error() string { return ErrNoQuorum.Error() }
+func (e *QuorumError) Unwrap() error { return ErrNoQuorum }
+
+// Lease is a held distributed lock: the per-peer tokens that make it
+// up, keyed by index into Client.Peers.
+type Lease struct {
+	Id     string
+	Mode   LockMode
+	Tokens map[int]string
+}
+
+// Client acquires and releases locks across a fixed set of peers. UID
+// identifies this client to peers so they can tell which holder a
+// token belongs to, and so contested grants can be broken deterministically
+// (see Yield) instead of live-locking.
+type Client struct {
+	UID     string
+	Peers   []Peer
+	WQuorum int // write (exclusive) quorum: N/2 + 1
+	RQuorum int // read (shared) quorum: N - WQuorum + 1
+}
+
+// New builds a Client against peers, deriving the write and read
+// quorum sizes from the peer count.
+func New(uid string, peers []Peer) *Client {
+	n := len(peers)
+	wq := n/2 + 1
+	return &Client{
+		UID:     uid,
+		Peers:   peers,
+		WQuorum: wq,
+		RQuorum: n - wq + 1,
+	}
+}
+
+// Yield reports whether this client should back off in favor of a
+// contending client identified by otherUID. Every client breaks ties on
+// contested writes the same way (lower UID wins), so two clients
+// racing on the same id converge on a winner instead of repeatedly
+// granting partial quorums and compensating forever. LockRetry is the
+// caller that actually applies this.
+func Yield(myUID, otherUID string) bool {
+	return myUID > otherUID
+}
+
+// retryBackoff is how long LockRetry sleeps when Yield says this
+// client should back off before trying again.
+const retryBackoff = 10 * time.Millisecond
+
+type grant struct {
+	peer   int
+	token  string
+	ok     bool
+	heldBy string
+}
+
+func (c *Client) acquire(id string, mode LockMode, quorum int) (*Lease, error) {
+	results := make(chan grant, len(c.Peers))
+	for i, p := range c.Peers {
+		go func(i int, p Peer) {
+			token, ok, heldBy := p.Lock(id, c.UID, mode)
+			results <- grant{i, token, ok, heldBy}
+		}(i, p)
+	}
+
+	granted := make(map[int]string)
+	var contenders []string
+	for range c.Peers {
+		g := <-results
+		if g.ok {
+			granted[g.peer] = g.token
+		} else if g.heldBy != "" {
+			contenders = append(contenders, g.heldBy)
+		}
+	}
+
+	if len(granted) < quorum {
+		c.release(id, granted)
+		return nil, &QuorumError{Contenders: contenders}
+	}
+
+	return &Lease{Id: id, Mode: mode, Tokens: granted}, nil
+}
+
+// soleContender reports the single UID in uids if every entry agrees,
+// so LockRetry can tell "every peer that rejected me named the same
+// other client" from "peers disagree" or "nobody could say".
+func soleContender(uids []string) (string, bool) {
+	if len(uids) == 0 {
+		return "", false
+	}
+	first := uids[0]
+	for _, u := range uids[1:] {
+		if u != first {
+			return "", false
+		}
+	}
+	return first, true
+}
+
+// LockRetry is like Lock but retries on contention instead of giving
+// up after one round. When every rejecting peer agrees on who holds
+// the lock, it consults Yield to decide how: the client Yield says
+// should back off sleeps before retrying, the other retries right
+// away, so two clients racing on the same id converge on a winner
+// instead of both retrying in lockstep forever. It gives up and
+// returns the last error after attempts rounds.
+func (c *Client) LockRetry(id string, attempts int) (*Lease, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		var lease *Lease
+		lease, err = c.Lock(id)
+		if err == nil {
+			return lease, nil
+		}
+
+		var qerr *QuorumError
+		if !errors.As(err, &qerr) {
+			return nil, err
+		}
+
+		if contender, ok := soleContender(qerr.Contenders); ok && Yield(c.UID, contender) {
+			time.Sleep(retryBackoff)
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) release(id string, tokens map[int]string) {
+	var wg sync.WaitGroup
+	for peer, token := range tokens {
+		wg.Add(1)
+		go func(peer int, token string) {
+			defer wg.Done()
+			c.Peers[peer].Unlock(id, token)
+		}(peer, token)
+	}
+	wg.Wait()
+}
+
+// Lock acquires an exclusive lock on id, blocking new Lock and RLock
+// grants on every peer that honors it.
+func (c *Client) Lock(id string) (*Lease, error) {
+	return c.acquire(id, Exclusive, c.WQuorum)
+}
+
+// RLock acquires a shared lock on id. Multiple RLock holders can
+// coexist, but RLock fails on any peer currently holding an Exclusive
+// grant for id.
+func (c *Client) RLock(id string) (*Lease, error) {
+	return c.acquire(id, Shared, c.RQuorum)
+}
+
+// Unlock releases every per-peer grant backing l.
+func (c *Client) Unlock(l *Lease) {
+	c.release(l.Id, l.Tokens)
+}
+
+// Refresh extends l's lease on every peer that still grants it and
+// reports whether enough peers renewed to keep the lock considered
+// held (the same quorum required to acquire it in the first place).
+func (c *Client) Refresh(l *Lease) bool {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ok := 0
+	for peer, token := range l.Tokens {
+		wg.Add(1)
+		go func(peer int, token string) {
+			defer wg.Done()
+			if c.Peers[peer].Refresh(l.Id, token) {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}(peer, token)
+	}
+	wg.Wait()
+
+	quorum := c.WQuorum
+	if l.Mode == Shared {
+		quorum = c.RQuorum
+	}
+	return ok >= quorum
+}
+
+// ForceUnlock broadcasts an administrative unlock for id to every
+// peer, regardless of who currently holds it.
+func (c *Client) ForceUnlock(id string) {
+	var wg sync.WaitGroup
+	for _, p := range c.Peers {
+		wg.Add(1)
+		go func(p Peer) {
+			defer wg.Done()
+			p.ForceUnlock(id)
+		}(p)
+	}
+	wg.Wait()
+}
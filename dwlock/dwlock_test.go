@@ -0,0 +1,263 @@
+package dwlock
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPeer is an in-memory Peer used to exercise Client without a real
+// wrpc transport. Setting down makes it behave like an unreachable
+// node (every call fails).
+type testPeer struct {
+	mu      sync.Mutex
+	down    bool
+	holders map[string][]holder
+}
+
+type holder struct {
+	token string
+	uid   string
+	mode  LockMode
+}
+
+func newTestPeer() *testPeer {
+	return &testPeer{holders: make(map[string][]holder)}
+}
+
+func (p *testPeer) Lock(id, uid string, mode LockMode) (string, bool, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return "", false, ""
+	}
+
+	hs := p.holders[id]
+	if mode == Exclusive {
+		if len(hs) > 0 {
+			return "", false, hs[0].uid
+		}
+	} else {
+		for _, h := range hs {
+			if h.mode == Exclusive {
+				return "", false, h.uid
+			}
+		}
+	}
+
+	token := fmt.Sprintf("%s:%d", uid, len(hs)+1)
+	p.holders[id] = append(hs, holder{token, uid, mode})
+	return token, true, ""
+}
+
+func (p *testPeer) Unlock(id, token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return false
+	}
+
+	hs := p.holders[id]
+	for i, h := range hs {
+		if h.token == token {
+			p.holders[id] = append(hs[:i], hs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *testPeer) Refresh(id, token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return false
+	}
+
+	for _, h := range p.holders[id] {
+		if h.token == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *testPeer) ForceUnlock(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return false
+	}
+
+	_, ok := p.holders[id]
+	delete(p.holders, id)
+	return ok
+}
+
+func (p *testPeer) count(id string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.holders[id])
+}
+
+func TestLockSucceedsWithPeerDown(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	peers[2].(*testPeer).down = true
+
+	c := New("client-a", peers)
+	lease, err := c.Lock("res")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if len(lease.Tokens) != 2 {
+		t.Fatalf("expected grants from the 2 live peers, got %d", len(lease.Tokens))
+	}
+}
+
+func TestLockFailsAndCompensatesOnPartition(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	peers[1].(*testPeer).down = true
+	peers[2].(*testPeer).down = true
+
+	c := New("client-a", peers)
+	_, err := c.Lock("res")
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expected ErrNoQuorum, got %v", err)
+	}
+
+	if n := peers[0].(*testPeer).count("res"); n != 0 {
+		t.Fatalf("expected compensating unlock on the lone live peer, still held by %d", n)
+	}
+}
+
+func TestConcurrentContendersExactlyOneWins(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	a := New("client-a", peers)
+	b := New("client-b", peers)
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := a.Lock("res")
+		results <- err == nil
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := b.Lock("res")
+		results <- err == nil
+	}()
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for ok := range results {
+		if ok {
+			succeeded++
+		}
+	}
+	// 3 peers can grant at most 3 exclusive slots between the two
+	// contenders, so one of them must reach the quorum of 2 and the
+	// other cannot also reach it.
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one contender to acquire quorum, got %d", succeeded)
+	}
+}
+
+func TestRLockAllowsMultipleReaders(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	a := New("client-a", peers)
+	b := New("client-b", peers)
+
+	if _, err := a.RLock("res"); err != nil {
+		t.Fatalf("a.RLock: %v", err)
+	}
+	if _, err := b.RLock("res"); err != nil {
+		t.Fatalf("b.RLock: %v", err)
+	}
+}
+
+func TestRLockBlocksAgainstHeldLock(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	a := New("client-a", peers)
+	b := New("client-b", peers)
+
+	if _, err := a.Lock("res"); err != nil {
+		t.Fatalf("a.Lock: %v", err)
+	}
+	if _, err := b.RLock("res"); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expected RLock to fail against a held exclusive lock, got %v", err)
+	}
+}
+
+func TestQuorumErrorReportsSoleContender(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	rival := New("rival", peers)
+	if _, err := rival.Lock("res"); err != nil {
+		t.Fatalf("rival.Lock: %v", err)
+	}
+
+	me := New("me", peers)
+	_, err := me.Lock("res")
+
+	var qerr *QuorumError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("expected *QuorumError, got %v", err)
+	}
+	contender, ok := soleContender(qerr.Contenders)
+	if !ok || contender != "rival" {
+		t.Fatalf("expected every rejecting peer to name %q, got %v", "rival", qerr.Contenders)
+	}
+}
+
+func TestLockRetryConvergesOnceContenderReleases(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	rival := New("rival", peers)
+	lease, err := rival.Lock("res")
+	if err != nil {
+		t.Fatalf("rival.Lock: %v", err)
+	}
+
+	const holdFor = 30 * time.Millisecond
+	time.AfterFunc(holdFor, func() { rival.Unlock(lease) })
+
+	// A higher UID than the rival's, so Yield has LockRetry back off
+	// between rounds instead of spending every attempt at once.
+	me := New("z-me", peers)
+	start := time.Now()
+	if _, err := me.LockRetry("res", 20); err != nil {
+		t.Fatalf("LockRetry: %v", err)
+	}
+	if time.Since(start) < holdFor {
+		t.Fatalf("expected LockRetry to keep retrying until the rival released, returned too soon")
+	}
+}
+
+func TestLockRetryLowerUIDDoesNotBackOff(t *testing.T) {
+	peers := []Peer{newTestPeer(), newTestPeer(), newTestPeer()}
+	rival := New("z-rival", peers)
+	if _, err := rival.Lock("res"); err != nil {
+		t.Fatalf("rival.Lock: %v", err)
+	}
+
+	me := New("a-me", peers)
+	if Yield(me.UID, rival.UID) {
+		t.Fatalf("lower UID should not be the one asked to yield")
+	}
+
+	start := time.Now()
+	_, err := me.LockRetry("res", 3)
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expected ErrNoQuorum once attempts are exhausted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= retryBackoff {
+		t.Fatalf("expected the lower-UID client to retry without backing off, took %v", elapsed)
+	}
+}
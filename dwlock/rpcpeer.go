@@ -0,0 +1,49 @@
+package dwlock
+
+import "github.com/webasis/wrpc"
+
+// RPCPeer is the default Peer implementation, talking to a remote
+// wlock node over wrpc.
+type RPCPeer struct {
+	Client *wrpc.Client
+}
+
+func (p *RPCPeer) Lock(id, uid string, mode LockMode) (token string, ok bool, heldBy string) {
+	method := "wlock/lock"
+	if mode == Shared {
+		method = "wlock/rlock"
+	}
+
+	resp, err := p.Client.Call(method, id, uid)
+	if err != nil {
+		return "", false, ""
+	}
+	if !resp.Ok {
+		// wlock/lock and wlock/rlock report the rejecting holder's UID
+		// as their one error value, if they know it, so LockRetry's
+		// Yield tie-break has something to act on.
+		if len(resp.Values) > 0 {
+			heldBy = resp.Values[0]
+		}
+		return "", false, heldBy
+	}
+	if len(resp.Values) == 0 {
+		return "", false, ""
+	}
+	return resp.Values[0], true, ""
+}
+
+func (p *RPCPeer) Unlock(id, token string) bool {
+	resp, err := p.Client.Call("wlock/unlock", id, token)
+	return err == nil && resp.Ok
+}
+
+func (p *RPCPeer) Refresh(id, token string) bool {
+	resp, err := p.Client.Call("wlock/refresh", id, token)
+	return err == nil && resp.Ok
+}
+
+func (p *RPCPeer) ForceUnlock(id string) bool {
+	resp, err := p.Client.Call("wlock/admin/force_unlock", id)
+	return err == nil && resp.Ok
+}
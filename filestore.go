@@ -0,0 +1,163 @@
+package wlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a Store backed by a JSON snapshot file plus a
+// write-ahead log of Save/Delete operations. Snapshot replays the
+// current snapshot and log into a compacted snapshot and truncates
+// the log; LockerManager calls it on every GCInterval.
+type FileStore struct {
+	mu sync.Mutex
+
+	snapshotPath string
+	walPath      string
+	wal          *os.File
+}
+
+type walEntry struct {
+	Op     string  `json:"op"` // "save" or "delete"
+	Id     string  `json:"id"`
+	Locker *Locker `json:"locker,omitempty"`
+}
+
+// NewFileStore opens (creating if necessary) a FileStore rooted at
+// dir: dir/snapshot.json and dir/wal.log.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		snapshotPath: filepath.Join(dir, "snapshot.json"),
+		walPath:      filepath.Join(dir, "wal.log"),
+	}
+
+	wal, err := os.OpenFile(fs.walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fs.wal = wal
+
+	return fs, nil
+}
+
+func (fs *FileStore) append(e walEntry) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+
+	_, err = fs.wal.Write(raw)
+	return err
+}
+
+func (fs *FileStore) Save(l *Locker) error {
+	return fs.append(walEntry{Op: "save", Id: l.Id, Locker: l})
+}
+
+func (fs *FileStore) Delete(id string) error {
+	return fs.append(walEntry{Op: "delete", Id: id})
+}
+
+// replay merges the on-disk snapshot with the log on top of it,
+// returning the resulting set of Lockers keyed by id.
+func (fs *FileStore) replay() (map[string]*Locker, error) {
+	lockers := make(map[string]*Locker)
+
+	raw, err := os.ReadFile(fs.snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var list []*Locker
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		for _, l := range list {
+			lockers[l.Id] = l
+		}
+	}
+
+	raw, err = os.ReadFile(fs.walPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// a partially written final line from a crash; stop here
+			break
+		}
+		switch e.Op {
+		case "save":
+			lockers[e.Id] = e.Locker
+		case "delete":
+			delete(lockers, e.Id)
+		}
+	}
+
+	return lockers, nil
+}
+
+func (fs *FileStore) Load() ([]*Locker, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lockers, err := fs.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Locker, 0, len(lockers))
+	for _, l := range lockers {
+		list = append(list, l)
+	}
+	return list, nil
+}
+
+func (fs *FileStore) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	lockers, err := fs.replay()
+	if err != nil {
+		return err
+	}
+
+	list := make([]*Locker, 0, len(lockers))
+	for _, l := range lockers {
+		list = append(list, l)
+	}
+
+	raw, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	tmp := fs.snapshotPath + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fs.snapshotPath); err != nil {
+		return err
+	}
+
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	_, err = fs.wal.Seek(0, 0)
+	return err
+}
@@ -0,0 +1,75 @@
+package wlock
+
+import "time"
+
+// Store is a pluggable persistence backend for LockerManager state.
+// Implementations must be safe for concurrent use; LockerManager calls
+// Save/Delete from inside its serialized command loop, and Snapshot
+// from its periodic GC tick.
+type Store interface {
+	// Load returns every Locker known to the store, for reconstructing
+	// LockerManager.Lockers on startup.
+	Load() ([]*Locker, error)
+	// Save persists the current state of l (a New/Lock/RLock/Unlock/Hold).
+	Save(l *Locker) error
+	// Delete removes the locker with the given id (a Free).
+	Delete(id string) error
+	// Snapshot compacts whatever write-ahead state the store has
+	// accumulated since the last snapshot. Called on GCInterval.
+	Snapshot() error
+}
+
+// NewWithStore builds a durable LockerManager backed by store,
+// replaying it to reconstruct Lockers and dropping any holder whose
+// lease had already expired by the time of the replay.
+func NewWithStore(store Store) (*LockerManager, error) {
+	const DEFAULT_SIZE = 1
+	lm := &LockerManager{
+		C:       make(chan LMFunc, DEFAULT_SIZE),
+		Lockers: make(map[string]*Locker),
+
+		NextId:             DefaultNextId(),
+		NextSecret:         DefaultNextSecret,
+		AutoFreeInterval:   time.Second * 300,
+		AutoUnlockInterval: time.Second * 60,
+		GCInterval:         time.Second * 600,
+
+		Store: store,
+	}
+
+	lockers, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, l := range lockers {
+		for token, h := range l.Holders {
+			if now.After(h.Deadline) {
+				delete(l.Holders, token)
+			}
+		}
+		// Waiters is excluded from persistence; start every loaded
+		// locker with an empty queue so that wake() never sends on a
+		// waiter that no caller of this process is receiving from.
+		l.Waiters = nil
+		lm.Lockers[l.Id] = l
+	}
+
+	go lm.loop()
+	return lm, nil
+}
+
+func (lm *LockerManager) persist(l *Locker) {
+	if lm.Store == nil {
+		return
+	}
+	lm.Store.Save(l)
+}
+
+func (lm *LockerManager) persistDelete(id string) {
+	if lm.Store == nil {
+		return
+	}
+	lm.Store.Delete(id)
+}
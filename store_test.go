@@ -0,0 +1,103 @@
+package wlock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	lm, err := NewWithStore(store)
+	if err != nil {
+		t.Fatalf("NewWithStore: %v", err)
+	}
+
+	var id, secret string
+	lm.Sync(func() {
+		id, secret = lm.New()
+	})
+
+	var token string
+	lm.Sync(func() {
+		token, _ = lm.Lock(id, "client-a", "worker", "main.go:1")
+	})
+	if token == "" {
+		t.Fatalf("failed to acquire lock")
+	}
+
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen NewFileStore: %v", err)
+	}
+
+	lm2, err := NewWithStore(reopened)
+	if err != nil {
+		t.Fatalf("NewWithStore on reopened store: %v", err)
+	}
+
+	var held bool
+	lm2.Sync(func() {
+		held = lm2.Touch(id, token)
+	})
+	if !held {
+		t.Fatalf("expected lock %q to survive a restart via the store", id)
+	}
+
+	var freed bool
+	lm2.Sync(func() {
+		freed = lm2.Free(id, secret)
+	})
+	if !freed {
+		t.Fatalf("expected Free to succeed with the original secret")
+	}
+}
+
+func TestNewWithStoreDropsExpiredLocks(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+
+	expired := &Locker{
+		Id:      "stale",
+		Secret:  "s",
+		Mode:    Exclusive,
+		Holders: map[string]*Holder{"tok": {Token: "tok", Deadline: time.Now().Add(-time.Minute)}},
+	}
+	if err := store.Save(expired); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	lm, err := NewWithStore(store)
+	if err != nil {
+		t.Fatalf("NewWithStore: %v", err)
+	}
+
+	var found bool
+	var holders int
+	lm.Sync(func() {
+		l := lm.Lockers["stale"]
+		found = l != nil
+		if l != nil {
+			holders = len(l.Holders)
+		}
+	})
+	if !found {
+		t.Fatalf("expected the locker itself to survive, only its expired holder dropped")
+	}
+	if holders != 0 {
+		t.Fatalf("expected expired holder to be dropped on replay, still have %d", holders)
+	}
+}
@@ -1,8 +1,11 @@
 package wlock
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,14 +14,67 @@ import (
 	"github.com/webasis/wrpc/wret"
 )
 
+// LockMode distinguishes a Shared (read) lock, which can have several
+// concurrent holders, from an Exclusive (write) lock, which can only
+// have one.
+type LockMode int
+
+const (
+	Shared LockMode = iota
+	Exclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case Shared:
+		return "shared"
+	case Exclusive:
+		return "exclusive"
+	default:
+		return "unknown"
+	}
+}
+
+// Holder is one token's grant on a Locker: its identity and when it
+// was acquired/last touched. A Locker holds one Holder per live token.
+type Holder struct {
+	Token  string
+	UID    string // identity of the holder, set at Lock/RLock time
+	Owner  string // human-readable owner tag (process name / hostname)
+	Source string // call-site string identifying where Lock was issued
+
+	AcquiredAt time.Time
+	LastTouch  time.Time // for display only; Deadline is authoritative
+	Deadline   time.Time // lease expiry; extended by Refresh
+}
+
+// waitGrant is handed to a parked WaitLock caller once its turn comes
+// up; an empty Token means the wait ended without a grant (the locker
+// was freed out from under it).
+type waitGrant struct {
+	Token    string
+	Deadline time.Time
+}
+
+// waiter is one parked WaitLock caller on a Locker's FIFO queue.
+type waiter struct {
+	uid, owner, source string
+	ch                 chan waitGrant
+}
+
 type Locker struct {
 	Id     string
 	Secret string // update while new/free
-	Token  string // update while lock/unlock
-	Locked bool
 
-	LastHold  time.Time // for auto free
-	LastTouch time.Time // for auto unlock
+	Mode    LockMode           // valid while len(Holders) > 0
+	Holders map[string]*Holder // token -> holder
+
+	// Waiters holds parked WaitLock channels, which cannot survive a
+	// restart. It is excluded from persistence (json:"-"), so waiters
+	// parked before a restart are not restored.
+	Waiters []*waiter `json:"-"`
+
+	LastHold time.Time // for auto free
 }
 
 type Status struct {
@@ -26,6 +82,17 @@ type Status struct {
 	Locked int `json:"locked"`
 }
 
+// LockInfo is the admin-facing view of one holder of a Locker.
+type LockInfo struct {
+	Id         string    `json:"id"`
+	UID        string    `json:"uid"`
+	Owner      string    `json:"owner"`
+	Source     string    `json:"source"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	LastTouch  time.Time `json:"last_touch"`
+	Type       string    `json:"type"`
+}
+
 type LMFunc func(lm *LockerManager)
 
 type LockerManager struct {
@@ -39,6 +106,10 @@ type LockerManager struct {
 	AutoFreeInterval   time.Duration
 	AutoUnlockInterval time.Duration
 	GCInterval         time.Duration
+
+	// Store is an optional durable backend; nil means in-memory only.
+	// Set via NewWithStore, not New.
+	Store Store
 }
 
 func DefaultNextId() func() string {
@@ -82,6 +153,9 @@ func (lm *LockerManager) loop() {
 			time.Sleep(lm.GCInterval)
 			lm.C <- func(lm *LockerManager) {
 				lm.GC()
+				if lm.Store != nil {
+					lm.Store.Snapshot()
+				}
 			}
 		}
 	}()
@@ -96,9 +170,10 @@ func (lm *LockerManager) gc(l *Locker) {
 		lm.Free(l.Id, l.Secret)
 		return
 	}
-	if l.Locked && time.Now().Sub(l.LastTouch) > lm.AutoUnlockInterval {
-		lm.Unlock(l.Id, l.Token)
-		return
+	for token, h := range l.Holders {
+		if time.Now().After(h.Deadline) {
+			lm.Unlock(l.Id, token)
+		}
 	}
 }
 
@@ -113,15 +188,14 @@ func (lm *LockerManager) New() (id string, secret string) {
 	secret = lm.NextSecret()
 	now := time.Now()
 	l := &Locker{
-		Id:        id,
-		Secret:    secret,
-		Token:     "",
-		Locked:    false,
-		LastHold:  now,
-		LastTouch: now,
+		Id:       id,
+		Secret:   secret,
+		Holders:  make(map[string]*Holder),
+		LastHold: now,
 	}
 
 	lm.Lockers[id] = l
+	lm.persist(l)
 	return id, secret
 }
 
@@ -135,7 +209,13 @@ func (lm *LockerManager) Free(id string, secret string) bool {
 		return false
 	}
 
+	for _, w := range l.Waiters {
+		w.ch <- waitGrant{}
+	}
+	l.Waiters = nil
+
 	delete(lm.Lockers, id)
+	lm.persistDelete(id)
 	return true
 }
 
@@ -150,25 +230,52 @@ func (lm *LockerManager) Hold(id string, secret string) bool {
 	}
 
 	l.LastHold = time.Now()
+	lm.persist(l)
 	return true
 }
 
-func (lm *LockerManager) Lock(id string) (token string) {
+// Lock acquires an exclusive lock on id and returns a token along with
+// the authoritative deadline of its lease. The caller must call
+// Refresh before the deadline to keep holding the lock; once the
+// deadline passes, the server considers the lease expired and will
+// grant the id to another caller.
+func (lm *LockerManager) Lock(id string, uid string, owner string, source string) (token string, deadline time.Time) {
+	return lm.acquire(id, Exclusive, uid, owner, source)
+}
+
+// RLock acquires a shared (read) lock on id. It can coexist with other
+// Shared holders but fails while id is held Exclusive.
+func (lm *LockerManager) RLock(id string, uid string, owner string, source string) (token string, deadline time.Time) {
+	return lm.acquire(id, Shared, uid, owner, source)
+}
+
+func (lm *LockerManager) acquire(id string, mode LockMode, uid string, owner string, source string) (token string, deadline time.Time) {
 	l := lm.Lockers[id]
 	if l == nil {
-		return ""
+		return "", time.Time{}
 	}
 
 	lm.gc(l)
 
-	if l.Locked == true {
-		return ""
+	if len(l.Holders) > 0 && !(mode == Shared && l.Mode == Shared) {
+		return "", time.Time{}
 	}
+
 	token = lm.NextSecret()
-	l.Token = token
-	l.Locked = true
-	l.LastTouch = time.Now()
-	return token
+	now := time.Now()
+	deadline = now.Add(lm.AutoUnlockInterval)
+	l.Holders[token] = &Holder{
+		Token:      token,
+		UID:        uid,
+		Owner:      owner,
+		Source:     source,
+		AcquiredAt: now,
+		LastTouch:  now,
+		Deadline:   deadline,
+	}
+	l.Mode = mode
+	lm.persist(l)
+	return token, deadline
 }
 
 func (lm *LockerManager) Unlock(id string, token string) bool {
@@ -177,16 +284,174 @@ func (lm *LockerManager) Unlock(id string, token string) bool {
 		return false
 	}
 
-	if l.Locked == false {
+	if _, ok := l.Holders[token]; !ok {
 		return false
 	}
 
-	if l.Token != token {
+	delete(l.Holders, token)
+	lm.persist(l)
+	lm.wake(l)
+	return true
+}
+
+// ForceUnlock clears every holder of id regardless of token, for
+// administrative recovery when a client has gone away for good. It
+// reports whether id was a known locker.
+func (lm *LockerManager) ForceUnlock(id string) bool {
+	l := lm.Lockers[id]
+	if l == nil {
 		return false
 	}
 
-	l.Locked = false
-	l.Token = ""
+	l.Holders = make(map[string]*Holder)
+	lm.persist(l)
+	lm.wake(l)
+	return true
+}
+
+// wake hands a freshly-minted token to queued WaitLock callers in FIFO
+// order as long as id is free to grant. Called from inside the LMFunc
+// loop (after Unlock), so no extra locking is needed around Waiters.
+func (lm *LockerManager) wake(l *Locker) {
+	for len(l.Waiters) > 0 && len(l.Holders) == 0 {
+		w := l.Waiters[0]
+		l.Waiters = l.Waiters[1:]
+		token, deadline := lm.acquire(l.Id, Exclusive, w.uid, w.owner, w.source)
+		w.ch <- waitGrant{Token: token, Deadline: deadline}
+	}
+}
+
+// WaitLock acquires an exclusive lock on id, parking on id's FIFO
+// waiter queue if it is currently held and returning as soon as it
+// becomes free, the timeout elapses, or ctx is done. ctx only
+// shortcuts the wait for in-process callers that have one to cancel;
+// the wlock/waitlock RPC handler calls it with context.Background(),
+// since wrpc.Req carries no per-connection context, so a disconnected
+// RPC caller's wait still runs to its timeout rather than being
+// cancelled early.
+func (lm *LockerManager) WaitLock(ctx context.Context, id string, uid string, owner string, source string, timeout time.Duration) (token string, deadline time.Time) {
+	ch := make(chan waitGrant, 1)
+	var missing, queued bool
+
+	lm.Sync(func() {
+		l := lm.Lockers[id]
+		if l == nil {
+			missing = true
+			return
+		}
+
+		lm.gc(l)
+		l = lm.Lockers[id]
+		if l == nil {
+			missing = true
+			return
+		}
+
+		if len(l.Holders) == 0 {
+			token, deadline = lm.acquire(id, Exclusive, uid, owner, source)
+			return
+		}
+
+		l.Waiters = append(l.Waiters, &waiter{uid: uid, owner: owner, source: source, ch: ch})
+		queued = true
+	})
+
+	if missing || !queued {
+		return token, deadline
+	}
+
+	select {
+	case g := <-ch:
+		return g.Token, g.Deadline
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+
+	// Timed out or cancelled: dequeue ourselves, unless a grant already
+	// raced in (in which case honor it rather than drop the token).
+	lm.Sync(func() {
+		l := lm.Lockers[id]
+		if l == nil {
+			return
+		}
+		for i, w := range l.Waiters {
+			if w.ch == ch {
+				l.Waiters = append(l.Waiters[:i], l.Waiters[i+1:]...)
+				return
+			}
+		}
+	})
+
+	select {
+	case g := <-ch:
+		return g.Token, g.Deadline
+	default:
+		return "", time.Time{}
+	}
+}
+
+// MLock acquires an Exclusive lock on every id in the group, all or
+// nothing: if any id is unknown or already held, none are acquired
+// and conflicts lists the offending ids. Duplicate ids are deduped
+// first, so a repeated id doesn't acquire twice and leak the first
+// token when the second overwrites it in tokens. ids is sorted
+// internally before acquisition so that two overlapping MLock calls
+// always contend for the same id first, rather than deadlocking on
+// opposite orders. deadlines mirrors Lock's (token, deadline)
+// contract, one entry per id in tokens.
+func (lm *LockerManager) MLock(ids []string, uid string, owner string, source string) (tokens map[string]string, deadlines map[string]time.Time, conflicts []string) {
+	seen := make(map[string]bool, len(ids))
+	sorted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, id := range sorted {
+		l := lm.Lockers[id]
+		if l == nil {
+			conflicts = append(conflicts, id)
+			continue
+		}
+		lm.gc(l)
+		if lm.Lockers[id] == nil || len(l.Holders) > 0 {
+			conflicts = append(conflicts, id)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, nil, conflicts
+	}
+
+	tokens = make(map[string]string, len(sorted))
+	deadlines = make(map[string]time.Time, len(sorted))
+	for _, id := range sorted {
+		token, deadline := lm.acquire(id, Exclusive, uid, owner, source)
+		tokens[id] = token
+		deadlines[id] = deadline
+	}
+	return tokens, deadlines, nil
+}
+
+// MUnlock releases every (id, token) pair in tokens as a group: if any
+// pair doesn't match a currently held lock, none are released.
+func (lm *LockerManager) MUnlock(tokens map[string]string) bool {
+	for id, token := range tokens {
+		l := lm.Lockers[id]
+		if l == nil {
+			return false
+		}
+		if _, ok := l.Holders[token]; !ok {
+			return false
+		}
+	}
+
+	for id, token := range tokens {
+		lm.Unlock(id, token)
+	}
 	return true
 }
 
@@ -196,16 +461,34 @@ func (lm *LockerManager) Touch(id string, token string) bool {
 		return false
 	}
 
-	if l.Locked == false {
+	h, ok := l.Holders[token]
+	if !ok {
 		return false
 	}
 
-	if l.Token != token {
-		return false
+	h.LastTouch = time.Now()
+	return true
+}
+
+// Refresh atomically extends token's lease on id and returns its new
+// deadline. Unlike Touch, which only records liveness, Refresh is what
+// actually keeps a lock from being considered expired.
+func (lm *LockerManager) Refresh(id string, token string) (deadline time.Time, ok bool) {
+	l := lm.Lockers[id]
+	if l == nil {
+		return time.Time{}, false
 	}
 
-	l.LastTouch = time.Now()
-	return true
+	h, exists := l.Holders[token]
+	if !exists {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	h.LastTouch = now
+	h.Deadline = now.Add(lm.AutoUnlockInterval)
+	lm.persist(l)
+	return h.Deadline, true
 }
 
 func (lm *LockerManager) Status() Status {
@@ -215,7 +498,7 @@ func (lm *LockerManager) Status() Status {
 	}
 
 	for _, l := range lm.Lockers {
-		if l.Locked {
+		if len(l.Holders) > 0 {
 			s.Locked++
 		}
 	}
@@ -223,6 +506,46 @@ func (lm *LockerManager) Status() Status {
 	return s
 }
 
+// holderUID returns the UID of an arbitrary current holder of id, or
+// "" if id is unknown or unheld. Used to tell a rejected Lock/RLock
+// caller who to retry against, so distributed clients (dwlock.Client)
+// can break contested-write ties instead of live-locking.
+func (lm *LockerManager) holderUID(id string) string {
+	l := lm.Lockers[id]
+	if l == nil {
+		return ""
+	}
+	for _, h := range l.Holders {
+		return h.UID
+	}
+	return ""
+}
+
+// Locks returns admin-facing info for every currently held lock, one
+// entry per holder. When staleOnly is set, only holders whose lease
+// has already expired (but have not yet been GC'd) are included.
+func (lm *LockerManager) Locks(staleOnly bool) []LockInfo {
+	infos := make([]LockInfo, 0)
+	for _, l := range lm.Lockers {
+		for _, h := range l.Holders {
+			if staleOnly && !time.Now().After(h.Deadline) {
+				continue
+			}
+
+			infos = append(infos, LockInfo{
+				Id:         l.Id,
+				UID:        h.UID,
+				Owner:      h.Owner,
+				Source:     h.Source,
+				AcquiredAt: h.AcquiredAt,
+				LastTouch:  h.LastTouch,
+				Type:       l.Mode.String(),
+			})
+		}
+	}
+	return infos
+}
+
 func (lm *LockerManager) Sync(fn func()) {
 	done := make(chan bool, 1)
 	lm.C <- func(lm *LockerManager) {
@@ -281,7 +604,8 @@ func Enable(rpc *wrpc.Server, lm *LockerManager) {
 			return wret.Error("args")
 		}
 
-		var status string
+		var status, mode string
+		var holders int
 		id := r.Args[0]
 		lm.Sync(func() {
 			l := lm.Lockers[id]
@@ -294,28 +618,101 @@ func Enable(rpc *wrpc.Server, lm *LockerManager) {
 				status = "not_found"
 				return
 			}
-			if l.Locked {
+			if len(l.Holders) > 0 {
 				status = "locked"
+				mode = l.Mode.String()
+				holders = len(l.Holders)
 			} else {
 				status = "unlocked"
 			}
 		})
 
-		return wret.OK(status)
+		return wret.OK(status, mode, fmt.Sprint(holders))
 	})
 	rpc.HandleFunc("wlock/lock", func(r wrpc.Req) wrpc.Resp {
-		if len(r.Args) != 1 {
+		if len(r.Args) < 1 || len(r.Args) > 4 {
 			return wret.Error("args")
 		}
 
 		id := r.Args[0]
+		var uid, owner, source string
+		if len(r.Args) > 1 {
+			uid = r.Args[1]
+		}
+		if len(r.Args) > 2 {
+			owner = r.Args[2]
+		}
+		if len(r.Args) > 3 {
+			source = r.Args[3]
+		}
+
 		var token string
+		var deadline time.Time
+		var heldBy string
 		lm.Sync(func() {
-			token = lm.Lock(id)
+			token, deadline = lm.Lock(id, uid, owner, source)
+			if len(token) == 0 {
+				heldBy = lm.holderUID(id)
+			}
 		})
 
 		if len(token) > 0 {
-			return wret.OK(token)
+			return wret.OK(token, fmt.Sprint(time.Until(deadline).Milliseconds()))
+		} else if heldBy != "" {
+			return wret.Error(heldBy)
+		} else {
+			return wret.Error()
+		}
+	})
+	rpc.HandleFunc("wlock/rlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 || len(r.Args) > 4 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		var uid, owner, source string
+		if len(r.Args) > 1 {
+			uid = r.Args[1]
+		}
+		if len(r.Args) > 2 {
+			owner = r.Args[2]
+		}
+		if len(r.Args) > 3 {
+			source = r.Args[3]
+		}
+
+		var token string
+		var deadline time.Time
+		var heldBy string
+		lm.Sync(func() {
+			token, deadline = lm.RLock(id, uid, owner, source)
+			if len(token) == 0 {
+				heldBy = lm.holderUID(id)
+			}
+		})
+
+		if len(token) > 0 {
+			return wret.OK(token, fmt.Sprint(time.Until(deadline).Milliseconds()))
+		} else if heldBy != "" {
+			return wret.Error(heldBy)
+		} else {
+			return wret.Error()
+		}
+	})
+	rpc.HandleFunc("wlock/runlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 2 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		token := r.Args[1]
+		var ok bool
+		lm.Sync(func() {
+			ok = lm.Unlock(id, token)
+		})
+
+		if ok {
+			return wret.OK()
 		} else {
 			return wret.Error()
 		}
@@ -358,6 +755,127 @@ func Enable(rpc *wrpc.Server, lm *LockerManager) {
 		}
 	})
 
+	rpc.HandleFunc("wlock/mlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 || len(r.Args) > 4 {
+			return wret.Error("args")
+		}
+
+		var ids []string
+		if err := json.Unmarshal([]byte(r.Args[0]), &ids); err != nil {
+			return wret.Error("args")
+		}
+		var uid, owner, source string
+		if len(r.Args) > 1 {
+			uid = r.Args[1]
+		}
+		if len(r.Args) > 2 {
+			owner = r.Args[2]
+		}
+		if len(r.Args) > 3 {
+			source = r.Args[3]
+		}
+
+		var tokens map[string]string
+		var deadlines map[string]time.Time
+		var conflicts []string
+		lm.Sync(func() {
+			tokens, deadlines, conflicts = lm.MLock(ids, uid, owner, source)
+		})
+
+		if conflicts != nil {
+			raw, err := json.Marshal(conflicts)
+			if err != nil {
+				return wret.IError(err.Error())
+			}
+			return wret.Error(string(raw))
+		}
+
+		tokensRaw, err := json.Marshal(tokens)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		leaseMs := make(map[string]int64, len(deadlines))
+		for id, deadline := range deadlines {
+			leaseMs[id] = time.Until(deadline).Milliseconds()
+		}
+		deadlinesRaw, err := json.Marshal(leaseMs)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		return wret.OK(string(tokensRaw), string(deadlinesRaw))
+	})
+	rpc.HandleFunc("wlock/munlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+
+		var tokens map[string]string
+		if err := json.Unmarshal([]byte(r.Args[0]), &tokens); err != nil {
+			return wret.Error("args")
+		}
+
+		var ok bool
+		lm.Sync(func() {
+			ok = lm.MUnlock(tokens)
+		})
+
+		if ok {
+			return wret.OK()
+		} else {
+			return wret.Error()
+		}
+	})
+	rpc.HandleFunc("wlock/waitlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 2 || len(r.Args) > 5 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		timeoutMs, err := strconv.ParseInt(r.Args[1], 10, 64)
+		if err != nil {
+			return wret.Error("args")
+		}
+		var uid, owner, source string
+		if len(r.Args) > 2 {
+			uid = r.Args[2]
+		}
+		if len(r.Args) > 3 {
+			owner = r.Args[3]
+		}
+		if len(r.Args) > 4 {
+			source = r.Args[4]
+		}
+
+		// No per-connection context is available from wrpc.Req, so a
+		// disconnected caller can't be cancelled early here; it still
+		// waits out the full timeout (see WaitLock's doc comment).
+		token, deadline := lm.WaitLock(context.Background(), id, uid, owner, source, time.Duration(timeoutMs)*time.Millisecond)
+		if len(token) == 0 {
+			return wret.Error()
+		}
+		return wret.OK(token, fmt.Sprint(time.Until(deadline).Milliseconds()))
+	})
+	rpc.HandleFunc("wlock/refresh", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 2 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		token := r.Args[1]
+		var deadline time.Time
+		var ok bool
+		lm.Sync(func() {
+			deadline, ok = lm.Refresh(id, token)
+		})
+
+		if !ok {
+			return wret.Error()
+		}
+		return wret.OK(fmt.Sprint(time.Until(deadline).Milliseconds()))
+	})
+
 	rpc.HandleFunc("wlock/admin/status", func(r wrpc.Req) wrpc.Resp {
 		var s Status
 		lm.Sync(func() {
@@ -371,4 +889,38 @@ func Enable(rpc *wrpc.Server, lm *LockerManager) {
 
 		return wret.OK(string(raw))
 	})
+
+	rpc.HandleFunc("wlock/admin/locks", func(r wrpc.Req) wrpc.Resp {
+		stale := len(r.Args) >= 1 && r.Args[0] == "stale"
+
+		var infos []LockInfo
+		lm.Sync(func() {
+			infos = lm.Locks(stale)
+		})
+
+		raw, err := json.Marshal(infos)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		return wret.OK(string(raw))
+	})
+
+	rpc.HandleFunc("wlock/admin/force_unlock", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		var ok bool
+		lm.Sync(func() {
+			ok = lm.ForceUnlock(id)
+		})
+
+		if ok {
+			return wret.OK()
+		} else {
+			return wret.Error()
+		}
+	})
 }
@@ -1,6 +1,7 @@
 package wlock
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -51,7 +52,7 @@ func TestLocker(t *testing.T) {
 				id, secret = lm.New()
 			})
 			call(func() {
-				token = lm.Lock(id)
+				token, _ = lm.Lock(id, "", "", "")
 			})
 			call(func() {
 				lm.Unlock(id, token)
@@ -63,3 +64,352 @@ func TestLocker(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestSharedLockMode(t *testing.T) {
+	lm := New()
+
+	var id string
+	lm.Sync(func() {
+		id, _ = lm.New()
+	})
+
+	var t1, t2 string
+	lm.Sync(func() {
+		t1, _ = lm.RLock(id, "", "", "")
+	})
+	lm.Sync(func() {
+		t2, _ = lm.RLock(id, "", "", "")
+	})
+	if t1 == "" || t2 == "" {
+		t.Fatalf("expected two concurrent RLock holders, got %q and %q", t1, t2)
+	}
+
+	var exclusive string
+	lm.Sync(func() {
+		exclusive, _ = lm.Lock(id, "", "", "")
+	})
+	if exclusive != "" {
+		t.Fatalf("expected Lock to fail while RLock holders are present")
+	}
+
+	lm.Sync(func() {
+		lm.Unlock(id, t1)
+		lm.Unlock(id, t2)
+	})
+
+	lm.Sync(func() {
+		exclusive, _ = lm.Lock(id, "", "", "")
+	})
+	if exclusive == "" {
+		t.Fatalf("expected Lock to succeed once all RLock holders released")
+	}
+
+	var shared string
+	lm.Sync(func() {
+		shared, _ = lm.RLock(id, "", "", "")
+	})
+	if shared != "" {
+		t.Fatalf("expected RLock to fail while an Exclusive holder is present")
+	}
+}
+
+func TestMLockAllOrNothing(t *testing.T) {
+	lm := New()
+
+	var a, b, c string
+	lm.Sync(func() {
+		a, _ = lm.New()
+		b, _ = lm.New()
+		c, _ = lm.New()
+	})
+
+	var held string
+	lm.Sync(func() {
+		held, _ = lm.Lock(b, "other", "", "")
+	})
+	if held == "" {
+		t.Fatalf("setup: failed to hold %q", b)
+	}
+
+	var tokens map[string]string
+	var deadlines map[string]time.Time
+	var conflicts []string
+	lm.Sync(func() {
+		tokens, deadlines, conflicts = lm.MLock([]string{a, b, c}, "client", "", "")
+	})
+	if tokens != nil {
+		t.Fatalf("expected no tokens when one id in the group is already held")
+	}
+	if deadlines != nil {
+		t.Fatalf("expected no deadlines when one id in the group is already held")
+	}
+	if len(conflicts) != 1 || conflicts[0] != b {
+		t.Fatalf("expected conflicts to list only %q, got %v", b, conflicts)
+	}
+
+	var aLocked, cLocked bool
+	lm.Sync(func() {
+		l := lm.Lockers[a]
+		aLocked = l != nil && len(l.Holders) > 0
+		l = lm.Lockers[c]
+		cLocked = l != nil && len(l.Holders) > 0
+	})
+	if aLocked || cLocked {
+		t.Fatalf("expected a and c to remain unlocked after a failed MLock")
+	}
+
+	lm.Sync(func() {
+		lm.Unlock(b, held)
+	})
+
+	lm.Sync(func() {
+		tokens, deadlines, conflicts = lm.MLock([]string{a, b, c}, "client", "", "")
+	})
+	if conflicts != nil {
+		t.Fatalf("expected MLock to succeed once %q is free, got conflicts %v", b, conflicts)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("expected a token for each of a, b, c, got %v", tokens)
+	}
+	if len(deadlines) != 3 {
+		t.Fatalf("expected a deadline for each of a, b, c, got %v", deadlines)
+	}
+
+	var unlocked bool
+	lm.Sync(func() {
+		unlocked = lm.MUnlock(tokens)
+	})
+	if !unlocked {
+		t.Fatalf("expected MUnlock to release the whole group")
+	}
+}
+
+func TestLocksListsHoldersAndFiltersStale(t *testing.T) {
+	lm := New()
+
+	var fresh, stale string
+	lm.Sync(func() {
+		fresh, _ = lm.New()
+		stale, _ = lm.New()
+	})
+
+	var freshToken string
+	lm.Sync(func() {
+		freshToken, _ = lm.Lock(fresh, "client-a", "worker", "main.go:1")
+	})
+	if freshToken == "" {
+		t.Fatalf("setup: failed to acquire %q", fresh)
+	}
+
+	var staleToken string
+	lm.Sync(func() {
+		staleToken, _ = lm.Lock(stale, "client-b", "worker", "main.go:2")
+		lm.Lockers[stale].Holders[staleToken].Deadline = time.Now().Add(-time.Minute)
+	})
+	if staleToken == "" {
+		t.Fatalf("setup: failed to acquire %q", stale)
+	}
+
+	var all []LockInfo
+	lm.Sync(func() {
+		all = lm.Locks(false)
+	})
+	if len(all) != 2 {
+		t.Fatalf("expected Locks(false) to list both holders, got %v", all)
+	}
+
+	var staleOnly []LockInfo
+	lm.Sync(func() {
+		staleOnly = lm.Locks(true)
+	})
+	if len(staleOnly) != 1 || staleOnly[0].Id != stale {
+		t.Fatalf("expected Locks(true) to list only the expired holder on %q, got %v", stale, staleOnly)
+	}
+	if staleOnly[0].UID != "client-b" || staleOnly[0].Owner != "worker" {
+		t.Fatalf("expected the stale LockInfo to carry the holder's uid/owner, got %+v", staleOnly[0])
+	}
+}
+
+func TestMLockDedupesIds(t *testing.T) {
+	lm := New()
+
+	var a string
+	lm.Sync(func() {
+		a, _ = lm.New()
+	})
+
+	var tokens map[string]string
+	lm.Sync(func() {
+		tokens, _, _ = lm.MLock([]string{a, a}, "client", "", "")
+	})
+	if len(tokens) != 1 {
+		t.Fatalf("expected a repeated id to produce a single token, got %v", tokens)
+	}
+
+	var held int
+	lm.Sync(func() {
+		held = len(lm.Lockers[a].Holders)
+	})
+	if held != 1 {
+		t.Fatalf("expected a repeated id to be acquired once, not leak an extra holder, got %d", held)
+	}
+}
+
+func TestWaitLockUnblocksOnUnlock(t *testing.T) {
+	lm := New()
+
+	var id string
+	lm.Sync(func() {
+		id, _ = lm.New()
+	})
+
+	var held string
+	lm.Sync(func() {
+		held, _ = lm.Lock(id, "holder", "", "")
+	})
+	if held == "" {
+		t.Fatalf("setup: failed to acquire")
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		token, _ := lm.WaitLock(context.Background(), id, "waiter", "", "", time.Second)
+		done <- token
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected WaitLock to block while the lock is held")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	lm.Sync(func() {
+		lm.Unlock(id, held)
+	})
+
+	select {
+	case token := <-done:
+		if token == "" {
+			t.Fatalf("expected WaitLock to be granted a token once the lock was released")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitLock did not unblock after Unlock")
+	}
+}
+
+func TestWaitLockTimesOut(t *testing.T) {
+	lm := New()
+
+	var id string
+	lm.Sync(func() {
+		id, _ = lm.New()
+	})
+
+	var held string
+	lm.Sync(func() {
+		held, _ = lm.Lock(id, "holder", "", "")
+	})
+	if held == "" {
+		t.Fatalf("setup: failed to acquire")
+	}
+
+	token, _ := lm.WaitLock(context.Background(), id, "waiter", "", "", time.Millisecond*20)
+	if token != "" {
+		t.Fatalf("expected WaitLock to time out with no token")
+	}
+}
+
+func TestWaitLockFIFOOrder(t *testing.T) {
+	lm := New()
+
+	var id string
+	lm.Sync(func() {
+		id, _ = lm.New()
+	})
+
+	var held string
+	lm.Sync(func() {
+		held, _ = lm.Lock(id, "holder", "", "")
+	})
+	if held == "" {
+		t.Fatalf("setup: failed to acquire")
+	}
+
+	order := make(chan string, 2)
+	for _, uid := range []string{"first", "second"} {
+		uid := uid
+		go func() {
+			lm.WaitLock(context.Background(), id, uid, "", "", time.Second)
+			order <- uid
+		}()
+		// give the waiter time to enqueue before starting the next one
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	lm.Sync(func() {
+		lm.Unlock(id, held)
+	})
+
+	first := <-order
+	if first != "first" {
+		t.Fatalf("expected the first waiter to be granted first, got %q", first)
+	}
+}
+
+func TestLeaseExpiryAllowsImmediateReacquire(t *testing.T) {
+	// Built by hand rather than via New() + field assignment: New()
+	// already starts the background loop goroutine, which reads
+	// AutoUnlockInterval/GCInterval, so assigning them afterward is a
+	// data race. Constructing the manager before starting loop sets
+	// them ahead of any goroutine that reads them.
+	lm := &LockerManager{
+		C:       make(chan LMFunc, 1),
+		Lockers: make(map[string]*Locker),
+
+		NextId:             DefaultNextId(),
+		NextSecret:         DefaultNextSecret,
+		AutoFreeInterval:   time.Second * 300,
+		AutoUnlockInterval: time.Millisecond * 20,
+		GCInterval:         time.Hour, // far in the future; eviction must happen inline
+	}
+	go lm.loop()
+
+	var id string
+	lm.Sync(func() {
+		id, _ = lm.New()
+	})
+
+	var tokenA string
+	lm.Sync(func() {
+		tokenA, _ = lm.Lock(id, "client-a", "", "")
+	})
+	if tokenA == "" {
+		t.Fatalf("client-a failed to acquire")
+	}
+
+	// client-a refreshes once...
+	lm.Sync(func() {
+		if _, ok := lm.Refresh(id, tokenA); !ok {
+			t.Fatalf("refresh failed")
+		}
+	})
+
+	// ...but then drops off the network and never refreshes again.
+	// Once its lease elapses, another client must be able to acquire
+	// immediately, without waiting for the (much longer) GC tick.
+	time.Sleep(lm.AutoUnlockInterval * 3)
+
+	var tokenB string
+	lm.Sync(func() {
+		tokenB, _ = lm.Lock(id, "client-b", "", "")
+	})
+	if tokenB == "" {
+		t.Fatalf("expected client-b to acquire after client-a's lease expired")
+	}
+
+	lm.Sync(func() {
+		if lm.Touch(id, tokenA) {
+			t.Fatalf("expired holder tokenA should no longer be valid")
+		}
+	})
+}